@@ -0,0 +1,256 @@
+// Package channelmerge implements the channel-selection engine behind the
+// rgba-channel-merge CLI: given a set of source images and, for each, a
+// mask describing which of its channels feeds which output channel, it
+// produces a single merged image. It has no dependency on the CLI or the
+// filesystem, so other Go programs can pack channels in-process.
+package channelmerge
+
+import (
+	"encoding/binary"
+	"image"
+	"runtime"
+	"sync"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Source is one input image and the mask describing how its channels
+// should be placed into the merged output. Mask must be in the grammar
+// understood by ParseMask.
+type Source struct {
+	Img  image.Image
+	Mask string
+}
+
+// Options controls how Merge builds the output image.
+type Options struct {
+	// BitDepth selects the per-channel bit depth of the merged image: "8",
+	// "16", or "auto". The zero value behaves like "auto": the result is
+	// 16-bit as soon as any source is a 16-bit RGBA image (*image.RGBA64 or
+	// *image.NRGBA64, or one with the matching color model), and 8-bit
+	// otherwise; 16-bit grayscale sources count as 8-bit.
+	BitDepth string
+
+	// Resize selects how sources smaller than the output are resampled to
+	// fill it: "none" (the zero value; leftover pixels are untouched,
+	// i.e. left opaque black), "nearest", "bilinear", or "lanczos".
+	Resize string
+
+	// Scaler overrides the resampler used for Resize == "lanczos". If nil,
+	// a golang.org/x/image/draw CatmullRom scaler is used. Ignored for
+	// other Resize values.
+	Scaler xdraw.Scaler
+
+	// RequireSameSize, if true, makes Merge fail fast with a descriptive
+	// error when sources don't all share the same dimensions, instead of
+	// resizing or zero-padding them.
+	RequireSameSize bool
+}
+
+// Merge combines the channels of sources into a single image, as described
+// by each Source's Mask. The merged image is sized to the largest source.
+// Sources smaller than that are resampled to fit when Options.Resize is
+// set, and otherwise leave the remaining output pixels untouched. The
+// returned image is *image.NRGBA for an 8-bit result, or *image.NRGBA64
+// for a 16-bit one.
+func Merge(sources []Source, opts Options) (image.Image, error) {
+	masks := make([]Mask, len(sources))
+	for i, src := range sources {
+		m, err := ParseMask(src.Mask)
+		if err != nil {
+			return nil, err
+		}
+		masks[i] = m
+	}
+
+	depth, err := resolveBitDepth(opts.BitDepth, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.RequireSameSize {
+		if err := requireSameSize(sources); err != nil {
+			return nil, err
+		}
+	}
+
+	var maxSize image.Point
+	for _, src := range sources {
+		size := src.Img.Bounds().Size()
+		if size.X > maxSize.X {
+			maxSize.X = size.X
+		}
+		if size.Y > maxSize.Y {
+			maxSize.Y = size.Y
+		}
+	}
+
+	imgs, err := resizeSources(sources, maxSize, depth, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := newOutputImage(depth, image.Rectangle{Max: maxSize})
+
+	mergeSources := make([]mergeSource, len(sources))
+	for i := range sources {
+		mergeSources[i] = newMergeSource(imgs[i], masks[i], depth)
+	}
+
+	mergeStrips(mergeSources, out)
+
+	return out.underlying(), nil
+}
+
+// mergeStrips splits out's rows into at most runtime.GOMAXPROCS(0)
+// horizontal strips and has a pool of workers apply every source's mask, in
+// source order, to one strip at a time, so no two workers ever touch the
+// same bytes of out.pix().
+func mergeStrips(sources []mergeSource, out outputImage) {
+	bounds := out.bounds()
+	height := bounds.Dy()
+	if height == 0 {
+		return
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > height {
+		workers = height
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	stripHeight := (height + workers - 1) / workers
+
+	type strip struct{ y0, y1 int }
+	jobs := make(chan strip, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				for _, src := range sources {
+					src.mergeInto(out, job.y0, job.y1)
+				}
+			}
+		}()
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stripHeight {
+		y1 := y + stripHeight
+		if y1 > bounds.Max.Y {
+			y1 = bounds.Max.Y
+		}
+		jobs <- strip{y0: y, y1: y1}
+	}
+	close(jobs)
+
+	wg.Wait()
+}
+
+// mergeSource is a single source image converted to the working bit depth,
+// with its mask precomputed into a maskLUT, ready to have its channels
+// copied into an outputImage.
+type mergeSource struct {
+	lut    maskLUT
+	rgba   *image.NRGBA
+	rgba64 *image.NRGBA64
+}
+
+// mergeInto writes this source's contribution to out, restricted to
+// output rows [y0, y1). Rows or columns the source doesn't have are left
+// untouched, the same as if the source were smaller than the output.
+func (s mergeSource) mergeInto(out outputImage, y0, y1 int) {
+	switch out.bitDepth() {
+	case bitDepth16:
+		s.mergeRows16(out, y0, y1)
+	default:
+		s.mergeRows8(out, y0, y1)
+	}
+}
+
+func (s mergeSource) mergeRows8(out outputImage, y0, y1 int) {
+	srcBounds := s.rgba.Bounds()
+	outBounds := out.bounds()
+	outPix := out.pix()
+	inPix := s.rgba.Pix
+	lut := s.lut
+
+	minY, maxY := clampRange(y0, y1, srcBounds.Min.Y, srcBounds.Max.Y)
+	minX, maxX := clampRange(outBounds.Min.X, outBounds.Max.X, srcBounds.Min.X, srcBounds.Max.X)
+
+	for y := minY; y < maxY; y++ {
+		for x := minX; x < maxX; x++ {
+			srcOff := s.rgba.PixOffset(x, y)
+			outOff := out.pixOffset(x, y)
+			for slot := 0; slot < 4; slot++ {
+				if lut.keep[slot] {
+					continue
+				}
+				var v byte
+				if idx := lut.copySrc[slot]; idx >= 0 {
+					v = inPix[srcOff+int(idx)]
+				} else {
+					v = lut.constVal[slot]
+				}
+				if lut.invert[slot] {
+					v = 0xff - v
+				}
+				outPix[outOff+slot] = v
+			}
+		}
+	}
+}
+
+func (s mergeSource) mergeRows16(out outputImage, y0, y1 int) {
+	srcBounds := s.rgba64.Bounds()
+	outBounds := out.bounds()
+	outPix := out.pix()
+	inPix := s.rgba64.Pix
+	lut := s.lut
+
+	minY, maxY := clampRange(y0, y1, srcBounds.Min.Y, srcBounds.Max.Y)
+	minX, maxX := clampRange(outBounds.Min.X, outBounds.Max.X, srcBounds.Min.X, srcBounds.Max.X)
+
+	for y := minY; y < maxY; y++ {
+		for x := minX; x < maxX; x++ {
+			srcOff := s.rgba64.PixOffset(x, y)
+			outOff := out.pixOffset(x, y)
+			for slot := 0; slot < 4; slot++ {
+				if lut.keep[slot] {
+					continue
+				}
+				var v uint16
+				if idx := lut.copySrc[slot]; idx >= 0 {
+					channelOff := srcOff + int(idx)*2
+					v = binary.BigEndian.Uint16(inPix[channelOff : channelOff+2])
+				} else {
+					// Constants are bit-replicated up to 16 bits so "#80"
+					// means the same relative level at either bit depth.
+					v = uint16(lut.constVal[slot])<<8 | uint16(lut.constVal[slot])
+				}
+				if lut.invert[slot] {
+					v = 0xffff - v
+				}
+				binary.BigEndian.PutUint16(outPix[outOff+slot*2:outOff+slot*2+2], v)
+			}
+		}
+	}
+}
+
+// clampRange intersects [lo, hi) with [boundLo, boundHi).
+func clampRange(lo, hi, boundLo, boundHi int) (int, int) {
+	if lo < boundLo {
+		lo = boundLo
+	}
+	if hi > boundHi {
+		hi = boundHi
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return lo, hi
+}
@@ -0,0 +1,37 @@
+package channelmerge_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/blblblu/rgba-channel-merge/channelmerge"
+)
+
+// newBenchSource builds a deterministic size x size NRGBA image so
+// benchmark runs are repeatable without depending on a random source.
+func newBenchSource(size int, seed byte) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i) ^ seed
+	}
+	return img
+}
+
+func benchmarkMerge(b *testing.B, size int) {
+	sources := []channelmerge.Source{
+		{Img: newBenchSource(size, 0x11), Mask: "rgba"},
+		{Img: newBenchSource(size, 0x77), Mask: "..ba"},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := channelmerge.Merge(sources, channelmerge.Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMerge1024(b *testing.B) { benchmarkMerge(b, 1024) }
+func BenchmarkMerge2048(b *testing.B) { benchmarkMerge(b, 2048) }
+func BenchmarkMerge4096(b *testing.B) { benchmarkMerge(b, 4096) }
@@ -0,0 +1,122 @@
+package channelmerge
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// bitDepth is the number of bits used to store each color channel sample in
+// the buffers Merge works with.
+type bitDepth int
+
+const (
+	bitDepth8  bitDepth = 8
+	bitDepth16 bitDepth = 16
+)
+
+// resolveBitDepth turns an Options.BitDepth value ("8", "16", "auto", or
+// "") into a concrete bitDepth. In auto mode, the result is 16-bit as soon
+// as detectBitDepth reports any source image as 16-bit.
+func resolveBitDepth(flag string, sources []Source) (bitDepth, error) {
+	switch flag {
+	case "", "auto":
+		for _, src := range sources {
+			if detectBitDepth(src.Img) == bitDepth16 {
+				return bitDepth16, nil
+			}
+		}
+		return bitDepth8, nil
+	case "8":
+		return bitDepth8, nil
+	case "16":
+		return bitDepth16, nil
+	default:
+		return 0, fmt.Errorf("invalid bit depth %q, must be one of 8, 16, auto", flag)
+	}
+}
+
+// detectBitDepth reports the native per-channel bit depth of img, as
+// decoded by the standard library. It returns bitDepth16 for
+// *image.RGBA64/*image.NRGBA64 images and for images whose color model is
+// color.RGBA64Model/color.NRGBA64Model (e.g. basn2c16/basn6a16 PNGs);
+// everything else, including 16-bit grayscale (*image.Gray16), is treated
+// as 8-bit.
+func detectBitDepth(img image.Image) bitDepth {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		return bitDepth16
+	}
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model:
+		return bitDepth16
+	}
+	return bitDepth8
+}
+
+// outputImage is the working buffer that merged channels are written into.
+// It is implemented by rgbaOutput (8 bits per channel) and rgba64Output (16
+// bits per channel) so the merge loop can stay agnostic of bit depth.
+type outputImage interface {
+	bitDepth() bitDepth
+	bounds() image.Rectangle
+	pix() []byte
+	pixOffset(x, y int) int
+	underlying() image.Image
+}
+
+type rgbaOutput struct {
+	*image.NRGBA
+}
+
+func (o *rgbaOutput) bitDepth() bitDepth      { return bitDepth8 }
+func (o *rgbaOutput) bounds() image.Rectangle { return o.Rect }
+func (o *rgbaOutput) pix() []byte             { return o.Pix }
+func (o *rgbaOutput) pixOffset(x, y int) int  { return o.PixOffset(x, y) }
+func (o *rgbaOutput) underlying() image.Image { return o.NRGBA }
+
+type rgba64Output struct {
+	*image.NRGBA64
+}
+
+func (o *rgba64Output) bitDepth() bitDepth      { return bitDepth16 }
+func (o *rgba64Output) bounds() image.Rectangle { return o.Rect }
+func (o *rgba64Output) pix() []byte             { return o.Pix }
+func (o *rgba64Output) pixOffset(x, y int) int  { return o.PixOffset(x, y) }
+func (o *rgba64Output) underlying() image.Image { return o.NRGBA64 }
+
+// newMergeSource converts img to the given bit depth, so its pixels can be
+// copied into an outputImage of the same depth byte-for-byte. Both buffers
+// are non-alpha-premultiplied (NRGBA/NRGBA64). An *image.NRGBA source at
+// 8 bits, or an *image.NRGBA64 source at 16 bits, is copied sample for
+// sample regardless of its alpha; any other source is converted through
+// premultiplied color, so its color channels lose precision where alpha is
+// low and come out as 0 where alpha is 0.
+func newMergeSource(img image.Image, mask Mask, depth bitDepth) mergeSource {
+	bounds := img.Bounds()
+	lut := newMaskLUT(mask)
+	switch depth {
+	case bitDepth16:
+		buf := image.NewNRGBA64(bounds)
+		draw.Draw(buf, bounds, img, bounds.Min, draw.Src)
+		return mergeSource{lut: lut, rgba64: buf}
+	default:
+		buf := image.NewNRGBA(bounds)
+		draw.Draw(buf, bounds, img, bounds.Min, draw.Src)
+		return mergeSource{lut: lut, rgba: buf}
+	}
+}
+
+func newOutputImage(depth bitDepth, bounds image.Rectangle) outputImage {
+	switch depth {
+	case bitDepth16:
+		img := image.NewNRGBA64(bounds)
+		draw.Draw(img, bounds, &image.Uniform{color.NRGBA64{A: 0xffff}}, image.Point{}, draw.Src)
+		return &rgba64Output{img}
+	default:
+		img := image.NewNRGBA(bounds)
+		draw.Draw(img, bounds, &image.Uniform{color.RGBA{A: 0xff}}, image.Point{}, draw.Src)
+		return &rgbaOutput{img}
+	}
+}
@@ -0,0 +1,126 @@
+package channelmerge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// opKind is the operation a single output channel performs when a source
+// image is merged in.
+type opKind byte
+
+const (
+	// opCopy copies SourceIndex's channel of the source image (optionally
+	// inverted) into the output channel.
+	opCopy opKind = iota
+	// opConst fills the output channel with ConstValue (optionally
+	// inverted).
+	opConst
+	// opKeep leaves the output channel untouched, so an earlier source's
+	// write to it survives.
+	opKeep
+)
+
+// channelOp describes what a single output channel (red, green, blue, or
+// alpha, depending on its position in a Mask) should be set to when one
+// source image is merged in.
+type channelOp struct {
+	Op          opKind
+	SourceIndex int  // source channel to copy from (0=r, 1=g, 2=b, 3=a), meaningful when Op == opCopy
+	ConstValue  byte // fill value, meaningful when Op == opConst
+	Invert      bool // invert the resulting sample via max-v
+}
+
+// Mask is a parsed, validated channel mask: one channelOp per output
+// channel, in red, green, blue, alpha order.
+type Mask [4]channelOp
+
+// ParseMask parses a channel mask string into a Mask. A mask is an
+// optional leading "~" (inverts every channel it sets below) followed by
+// exactly four tokens, one per output channel (red, green, blue, alpha):
+//
+//	r, g, b, a   copy the matching channel of the source image
+//	x, .         leave this output channel untouched (x: "source doesn't
+//	             have this"; .: "don't clobber an earlier source's write")
+//	0, 1         fill with the constant 0x00 or 0xFF
+//	#XX          fill with the constant byte 0xXX, e.g. #80
+func ParseMask(s string) (Mask, error) {
+	invert := false
+	if strings.HasPrefix(s, "~") {
+		invert = true
+		s = s[1:]
+	}
+
+	var m Mask
+	pos := 0
+	for slot := 0; slot < 4; slot++ {
+		if pos >= len(s) {
+			return Mask{}, fmt.Errorf("channel mask %q has wrong length", s)
+		}
+
+		switch c := s[pos]; c {
+		case 'r', 'g', 'b', 'a':
+			m[slot] = channelOp{Op: opCopy, SourceIndex: strings.IndexByte("rgba", c), Invert: invert}
+			pos++
+		case 'x', '.':
+			m[slot] = channelOp{Op: opKeep}
+			pos++
+		case '0':
+			m[slot] = channelOp{Op: opConst, ConstValue: 0x00, Invert: invert}
+			pos++
+		case '1':
+			m[slot] = channelOp{Op: opConst, ConstValue: 0xff, Invert: invert}
+			pos++
+		case '#':
+			if pos+3 > len(s) {
+				return Mask{}, fmt.Errorf("truncated #hex constant in channel mask %q", s)
+			}
+			v, err := strconv.ParseUint(s[pos+1:pos+3], 16, 8)
+			if err != nil {
+				return Mask{}, fmt.Errorf("invalid #hex constant %q in channel mask %q", s[pos:pos+3], s)
+			}
+			m[slot] = channelOp{Op: opConst, ConstValue: byte(v), Invert: invert}
+			pos += 3
+		default:
+			return Mask{}, fmt.Errorf("illegal character %q in channel mask %q", c, s)
+		}
+	}
+
+	if pos != len(s) {
+		return Mask{}, fmt.Errorf("channel mask %q has trailing characters", s)
+	}
+
+	return m, nil
+}
+
+// maskLUT is Mask rewritten for the merge hot loop. Building it once per
+// source, instead of re-inspecting each channelOp.Op on every pixel, lets
+// the loop read it as pure index arithmetic and byte/word copies: copySrc
+// gives the source channel index to copy for a slot, or -1 if the slot
+// isn't a copy (constVal / keep apply instead).
+type maskLUT struct {
+	copySrc  [4]int8
+	constVal [4]byte
+	keep     [4]bool
+	invert   [4]bool
+}
+
+// newMaskLUT precomputes m's maskLUT.
+func newMaskLUT(m Mask) maskLUT {
+	var lut maskLUT
+	for slot, op := range m {
+		lut.invert[slot] = op.Invert
+		switch op.Op {
+		case opCopy:
+			lut.copySrc[slot] = int8(op.SourceIndex)
+		case opConst:
+			lut.copySrc[slot] = -1
+			lut.constVal[slot] = op.ConstValue
+		case opKeep:
+			lut.copySrc[slot] = -1
+			lut.keep[slot] = true
+		}
+	}
+	return lut
+}
@@ -0,0 +1,224 @@
+package channelmerge
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// requireSameSize returns a descriptive error if sources don't all share
+// the same image dimensions.
+func requireSameSize(sources []Source) error {
+	if len(sources) == 0 {
+		return nil
+	}
+
+	want := sources[0].Img.Bounds().Size()
+	for i, src := range sources[1:] {
+		got := src.Img.Bounds().Size()
+		if got != want {
+			return fmt.Errorf("source images have mismatched sizes: source 0 is %dx%d but source %d is %dx%d", want.X, want.Y, i+1, got.X, got.Y)
+		}
+	}
+	return nil
+}
+
+// resizeSources returns, for each source, the image to merge: either the
+// source itself (Resize == "none"/"", or it's already size) or a copy
+// resampled to size at the working bit depth, so resampling a 16-bit
+// source doesn't truncate it to 8 bits before the merge.
+func resizeSources(sources []Source, size image.Point, depth bitDepth, opts Options) ([]image.Image, error) {
+	mode := opts.Resize
+	if mode == "" {
+		mode = "none"
+	}
+
+	imgs := make([]image.Image, len(sources))
+	for i, src := range sources {
+		img := src.Img
+		if mode != "none" && img.Bounds().Size() != size {
+			resized, err := resize(img, size, mode, depth, opts.Scaler)
+			if err != nil {
+				return nil, err
+			}
+			img = resized
+		}
+		imgs[i] = img
+	}
+	return imgs, nil
+}
+
+// resize resamples img to size using the named algorithm: "nearest" and
+// "bilinear" are small, self-contained resamplers; "lanczos" delegates to
+// a golang.org/x/image/draw scaler (scaler, or a CatmullRom scaler by
+// default, since x/image/draw has no literal Lanczos kernel but CatmullRom
+// gives comparably sharp results). The returned image is buffered at
+// depth's precision (NRGBA for 8-bit, NRGBA64 for 16-bit).
+func resize(img image.Image, size image.Point, mode string, depth bitDepth, scaler xdraw.Scaler) (image.Image, error) {
+	switch mode {
+	case "nearest":
+		return resizeNearest(img, size, depth), nil
+	case "bilinear":
+		return resizeBilinear(img, size, depth), nil
+	case "lanczos":
+		if scaler == nil {
+			scaler = xdraw.CatmullRom
+		}
+		dst := newResizeBuffer(depth, size)
+		scaler.Scale(dst, dst.Bounds(), img, img.Bounds(), xdraw.Over, nil)
+		return dst, nil
+	default:
+		return nil, fmt.Errorf("invalid resize mode %q, must be one of none, nearest, bilinear, lanczos", mode)
+	}
+}
+
+// newResizeBuffer allocates the buffer a resize algorithm renders into, at
+// depth's precision.
+func newResizeBuffer(depth bitDepth, size image.Point) draw.Image {
+	if depth == bitDepth16 {
+		return image.NewNRGBA64(image.Rectangle{Max: size})
+	}
+	return image.NewNRGBA(image.Rectangle{Max: size})
+}
+
+func resizeNearest(src image.Image, size image.Point, depth bitDepth) image.Image {
+	sb := src.Bounds()
+	dst := newResizeBuffer(depth, size)
+	if sb.Dx() == 0 || sb.Dy() == 0 || size.X == 0 || size.Y == 0 {
+		return dst
+	}
+
+	for y := 0; y < size.Y; y++ {
+		sy := sb.Min.Y + y*sb.Dy()/size.Y
+		for x := 0; x < size.X; x++ {
+			sx := sb.Min.X + x*sb.Dx()/size.X
+			dst.Set(x, y, src.At(sx, sy))
+		}
+	}
+	return dst
+}
+
+func resizeBilinear(src image.Image, size image.Point, depth bitDepth) image.Image {
+	if depth == bitDepth16 {
+		return resizeBilinear16(src, size)
+	}
+
+	sb := src.Bounds()
+	dst := image.NewNRGBA(image.Rectangle{Max: size})
+	if sb.Dx() == 0 || sb.Dy() == 0 || size.X == 0 || size.Y == 0 {
+		return dst
+	}
+
+	scaleX := float64(sb.Dx()) / float64(size.X)
+	scaleY := float64(sb.Dy()) / float64(size.Y)
+
+	for y := 0; y < size.Y; y++ {
+		srcY := (float64(y)+0.5)*scaleY - 0.5 + float64(sb.Min.Y)
+		y0 := int(math.Floor(srcY))
+		fy := srcY - float64(y0)
+		y1 := clampInt(y0+1, sb.Min.Y, sb.Max.Y-1)
+		y0 = clampInt(y0, sb.Min.Y, sb.Max.Y-1)
+
+		for x := 0; x < size.X; x++ {
+			srcX := (float64(x)+0.5)*scaleX - 0.5 + float64(sb.Min.X)
+			x0 := int(math.Floor(srcX))
+			fx := srcX - float64(x0)
+			x1 := clampInt(x0+1, sb.Min.X, sb.Max.X-1)
+			x0 = clampInt(x0, sb.Min.X, sb.Max.X-1)
+
+			c00 := color.NRGBAModel.Convert(src.At(x0, y0)).(color.NRGBA)
+			c10 := color.NRGBAModel.Convert(src.At(x1, y0)).(color.NRGBA)
+			c01 := color.NRGBAModel.Convert(src.At(x0, y1)).(color.NRGBA)
+			c11 := color.NRGBAModel.Convert(src.At(x1, y1)).(color.NRGBA)
+
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: lerp2D(c00.R, c10.R, c01.R, c11.R, fx, fy),
+				G: lerp2D(c00.G, c10.G, c01.G, c11.G, fx, fy),
+				B: lerp2D(c00.B, c10.B, c01.B, c11.B, fx, fy),
+				A: lerp2D(c00.A, c10.A, c01.A, c11.A, fx, fy),
+			})
+		}
+	}
+	return dst
+}
+
+// resizeBilinear16 is resizeBilinear's 16-bit-per-channel counterpart, used
+// when the working bit depth is 16-bit so resampling doesn't discard the
+// source's extra precision.
+func resizeBilinear16(src image.Image, size image.Point) image.Image {
+	sb := src.Bounds()
+	dst := image.NewNRGBA64(image.Rectangle{Max: size})
+	if sb.Dx() == 0 || sb.Dy() == 0 || size.X == 0 || size.Y == 0 {
+		return dst
+	}
+
+	scaleX := float64(sb.Dx()) / float64(size.X)
+	scaleY := float64(sb.Dy()) / float64(size.Y)
+
+	for y := 0; y < size.Y; y++ {
+		srcY := (float64(y)+0.5)*scaleY - 0.5 + float64(sb.Min.Y)
+		y0 := int(math.Floor(srcY))
+		fy := srcY - float64(y0)
+		y1 := clampInt(y0+1, sb.Min.Y, sb.Max.Y-1)
+		y0 = clampInt(y0, sb.Min.Y, sb.Max.Y-1)
+
+		for x := 0; x < size.X; x++ {
+			srcX := (float64(x)+0.5)*scaleX - 0.5 + float64(sb.Min.X)
+			x0 := int(math.Floor(srcX))
+			fx := srcX - float64(x0)
+			x1 := clampInt(x0+1, sb.Min.X, sb.Max.X-1)
+			x0 = clampInt(x0, sb.Min.X, sb.Max.X-1)
+
+			c00 := color.NRGBA64Model.Convert(src.At(x0, y0)).(color.NRGBA64)
+			c10 := color.NRGBA64Model.Convert(src.At(x1, y0)).(color.NRGBA64)
+			c01 := color.NRGBA64Model.Convert(src.At(x0, y1)).(color.NRGBA64)
+			c11 := color.NRGBA64Model.Convert(src.At(x1, y1)).(color.NRGBA64)
+
+			dst.SetNRGBA64(x, y, color.NRGBA64{
+				R: lerp2D16(c00.R, c10.R, c01.R, c11.R, fx, fy),
+				G: lerp2D16(c00.G, c10.G, c01.G, c11.G, fx, fy),
+				B: lerp2D16(c00.B, c10.B, c01.B, c11.B, fx, fy),
+				A: lerp2D16(c00.A, c10.A, c01.A, c11.A, fx, fy),
+			})
+		}
+	}
+	return dst
+}
+
+func lerp2D(v00, v10, v01, v11 byte, fx, fy float64) byte {
+	top := float64(v00)*(1-fx) + float64(v10)*fx
+	bottom := float64(v01)*(1-fx) + float64(v11)*fx
+	v := math.Round(top*(1-fy) + bottom*fy)
+	return byte(clampFloat(v, 0, 255))
+}
+
+func lerp2D16(v00, v10, v01, v11 uint16, fx, fy float64) uint16 {
+	top := float64(v00)*(1-fx) + float64(v10)*fx
+	bottom := float64(v01)*(1-fx) + float64(v11)*fx
+	v := math.Round(top*(1-fy) + bottom*fy)
+	return uint16(clampFloat(v, 0, 65535))
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func clampFloat(v, lo, hi float64) float64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
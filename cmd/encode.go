@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg" // also registers jpeg decoding for image.Decode
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// encodeOptions carries the format-specific flags that an encodeFunc may need.
+type encodeOptions struct {
+	jpegQuality int
+}
+
+type encodeFunc func(w io.Writer, img image.Image, opts encodeOptions) error
+
+var encoders = map[string]encodeFunc{
+	".png":  encodePNG,
+	".jpg":  encodeJPEG,
+	".jpeg": encodeJPEG,
+	".bmp":  encodeBMP,
+	".tif":  encodeTIFF,
+	".tiff": encodeTIFF,
+	".gif":  encodeGIF,
+}
+
+// encoderFor looks up the encodeFunc registered for the extension of path.
+func encoderFor(path string) (encodeFunc, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	enc, ok := encoders[ext]
+	if !ok {
+		return nil, fmt.Errorf("unsupported output format %q", ext)
+	}
+	return enc, nil
+}
+
+func encodePNG(w io.Writer, img image.Image, opts encodeOptions) error {
+	// png.Encode type-switches on the concrete image type to decide the bit
+	// depth it writes, so img must be the concrete *image.NRGBA/*image.NRGBA64
+	// produced by channelmerge.Merge rather than a wrapper around it.
+	return png.Encode(w, img)
+}
+
+func encodeJPEG(w io.Writer, img image.Image, opts encodeOptions) error {
+	// JPEG has no alpha channel; downgrade to a plain 8-bit RGBA buffer so
+	// the encoder never has to reason about 16-bit pixels.
+	return jpeg.Encode(w, toRGBA(img), &jpeg.Options{Quality: opts.jpegQuality})
+}
+
+func encodeGIF(w io.Writer, img image.Image, opts encodeOptions) error {
+	return gif.Encode(w, toRGBA(img), nil)
+}
+
+func encodeTIFF(w io.Writer, img image.Image, opts encodeOptions) error {
+	return tiff.Encode(w, img, nil)
+}
+
+// encodeBMP writes the merged image as BMP. golang.org/x/image/bmp can only
+// write fully opaque images, so a fully opaque result is downgraded to
+// 8-bit RGB and handed to it; anything with a non-opaque alpha channel is
+// written by hand as a 32-bit BI_BITFIELDS bitmap that carries the alpha
+// channel.
+func encodeBMP(w io.Writer, img image.Image, opts encodeOptions) error {
+	if isOpaque(img) {
+		return bmp.Encode(w, toRGBA(img))
+	}
+	return writeBMP32(w, img)
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	bounds := img.Bounds()
+	out := image.NewRGBA(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+	return out
+}
+
+// writeBMP32 writes img as an uncompressed 32-bit BMP using a
+// BITMAPV4HEADER with BI_BITFIELDS. BITMAPV4HEADER (biSize=108) is the
+// smallest DIB header that can declare an alpha mask; the older 40-byte
+// BITMAPINFOHEADER has no field for one, so a reader has no standard way
+// to know the 4th byte of each pixel is alpha rather than padding.
+func writeBMP32(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rowSize := width * 4
+	pixelDataSize := rowSize * height
+
+	const fileHeaderSize = 14
+	const dibHeaderSize = 108 // BITMAPV4HEADER
+	pixelOffset := fileHeaderSize + dibHeaderSize
+	fileSize := pixelOffset + pixelDataSize
+
+	bw := bufio.NewWriter(w)
+
+	// BITMAPFILEHEADER
+	bw.WriteString("BM")
+	binary.Write(bw, binary.LittleEndian, uint32(fileSize))
+	binary.Write(bw, binary.LittleEndian, uint32(0)) // reserved
+	binary.Write(bw, binary.LittleEndian, uint32(pixelOffset))
+
+	// BITMAPV4HEADER
+	binary.Write(bw, binary.LittleEndian, uint32(dibHeaderSize))
+	binary.Write(bw, binary.LittleEndian, int32(width))
+	binary.Write(bw, binary.LittleEndian, int32(height))
+	binary.Write(bw, binary.LittleEndian, uint16(1))  // planes
+	binary.Write(bw, binary.LittleEndian, uint16(32)) // bits per pixel
+	binary.Write(bw, binary.LittleEndian, uint32(3))  // BI_BITFIELDS
+	binary.Write(bw, binary.LittleEndian, uint32(pixelDataSize))
+	binary.Write(bw, binary.LittleEndian, int32(2835)) // ~72 DPI
+	binary.Write(bw, binary.LittleEndian, int32(2835))
+	binary.Write(bw, binary.LittleEndian, uint32(0)) // colors used
+	binary.Write(bw, binary.LittleEndian, uint32(0)) // important colors
+
+	// color masks, in B,G,R,A byte order per pixel
+	binary.Write(bw, binary.LittleEndian, uint32(0x00ff0000)) // red mask
+	binary.Write(bw, binary.LittleEndian, uint32(0x0000ff00)) // green mask
+	binary.Write(bw, binary.LittleEndian, uint32(0x000000ff)) // blue mask
+	binary.Write(bw, binary.LittleEndian, uint32(0xff000000)) // alpha mask
+
+	const lcsSRGB = 0x73524742 // LCS_sRGB
+	binary.Write(bw, binary.LittleEndian, uint32(lcsSRGB))
+	// bV4Endpoints (CIEXYZTRIPLE, 36 bytes) and the three bV4Gamma* fields
+	// only matter for LCS_CALIBRATED_RGB, so they're left zeroed.
+	bw.Write(make([]byte, 36+4+4+4))
+
+	row := make([]byte, rowSize)
+	for y := height - 1; y >= 0; y-- {
+		for x := 0; x < width; x++ {
+			nc := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			row[x*4+0] = nc.B
+			row[x*4+1] = nc.G
+			row[x*4+2] = nc.R
+			row[x*4+3] = nc.A
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"image"
+	"os"
+)
+
+type inputImage struct {
+	filepath    string
+	channelMask string // something like "rxxb" would mean that the output's red channel is taken from this image's red channel and the output's alpha channel from its blue channel, with green and blue left untouched
+	decoded     image.Image
+}
+
+type inputImages []inputImage
+
+func (img *inputImage) decode() error {
+	inFile, err := os.Open(img.filepath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	inImg, _, err := image.Decode(inFile)
+	if err != nil {
+		return err
+	}
+
+	img.decoded = inImg
+
+	return nil
+}
+
+func (images inputImages) decodeAll() error {
+	for i := range images {
+		if err := images[i].decode(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,24 +2,19 @@ package cmd
 
 import (
 	"fmt"
-	"image"
-	"image/color"
-	"image/draw"
-	_ "image/jpeg" // allow use of jpegs
-	"image/png"    // allow use of pngs
 	"os"
-	"path/filepath"
 
 	"github.com/spf13/cobra"
-)
 
-type inputImage struct {
-	filepath    string
-	channelMask string // something like "rxxb" would mean that the first channel will be used as red channel, and the alpha channel will be used als blue channel
-	rgba        *image.RGBA
-}
+	"github.com/blblblu/rgba-channel-merge/channelmerge"
+)
 
-type inputImages []inputImage
+var (
+	bitDepthFlag        string
+	jpegQualityFlag     int
+	resizeFlag          string
+	requireSameSizeFlag bool
+)
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -27,7 +22,13 @@ var RootCmd = &cobra.Command{
 	Short: "image channel merge tool",
 	Long: `A tool to merge specific color channels of multiple images into one rgba image.
 
-The channel masks for each image should match the regex [rgbax]{4}, with r, g, b, and a representing the red, green, blue and alpha channel, and x meaning that this channel should be ignored. E.g., the channel mask "rbax" would mean that the first (red) channel of the input image will be used as the red channel for the output image, the second (green) will be used as the blue channel, the third (blue) will be used as alpha channel, and the fourth (alpha) will be ignored.`,
+Each image is followed by a 4-token channel mask describing the output's red, green, blue, and alpha channel, in that order. Each token is one of: r, g, b, a (copy the matching channel of this image); 0, 1 (fill with the constant 0x00/0xFF); #XX (fill with the constant byte 0xXX, e.g. #80); or x/. (leave this output channel untouched, so an earlier image's write to it survives). An optional leading "~" inverts every sample the mask writes (255-v, or 65535-v for 16-bit output). E.g., the channel mask "rbax" would mean that the output's red channel is the image's red channel, the output's green channel is the image's blue channel, the output's blue channel is the image's alpha channel, and the output's alpha channel is left untouched.
+
+By default, output precision is picked automatically (--bit-depth=auto): the merged image is 16 bits per channel as soon as any input is a 16-bit RGB or RGBA image, and 8 bits per channel otherwise (16-bit grayscale inputs count as 8-bit).
+
+The output format is chosen from the output file's extension: .png, .jpg/.jpeg, .bmp, .tif/.tiff, and .gif are supported. Formats that cannot represent an alpha channel are written from a flattened, opaque copy of the merged image.
+
+Inputs smaller than the largest one are padded with opaque black by default; pass --resize to resample them up to the output size instead, or --require-same-size to fail instead of either.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		imgs, outputPath, err := parseArgs(args)
 		if err != nil {
@@ -35,16 +36,31 @@ The channel masks for each image should match the regex [rgbax]{4}, with r, g, b
 			os.Exit(1)
 		}
 
-		maxSize, err := imgs.openImages()
+		encode, err := encoderFor(outputPath)
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+
+		if err := imgs.decodeAll(); err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err)
 			os.Exit(2)
 		}
 
-		outImg := image.NewNRGBA(image.Rectangle{Min: image.Point{0, 0}, Max: maxSize})
-		draw.Draw(outImg, outImg.Bounds(), &image.Uniform{color.RGBA{0, 0, 0, 255}}, image.ZP, draw.Src)
+		sources := make([]channelmerge.Source, len(imgs))
+		for i, img := range imgs {
+			sources[i] = channelmerge.Source{Img: img.decoded, Mask: img.channelMask}
+		}
 
-		imgs.mergeChannels(outImg)
+		outImg, err := channelmerge.Merge(sources, channelmerge.Options{
+			BitDepth:        bitDepthFlag,
+			Resize:          resizeFlag,
+			RequireSameSize: requireSameSizeFlag,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(2)
+		}
 
 		outFile, err := os.Create(outputPath)
 		if err != nil {
@@ -53,7 +69,10 @@ The channel masks for each image should match the regex [rgbax]{4}, with r, g, b
 		}
 		defer outFile.Close()
 
-		png.Encode(outFile, outImg)
+		if err := encode(outFile, outImg, encodeOptions{jpegQuality: jpegQualityFlag}); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(4)
+		}
 	},
 }
 
@@ -65,18 +84,11 @@ func parseArgs(args []string) (imgs inputImages, outputPath string, err error) {
 
 	for i := 0; i < (len(args)-1)/2; i++ {
 		channelMask := args[i*2+1]
-		if len(channelMask) != 4 {
-			err = fmt.Errorf("channel mask \"%s\" has wrong length", channelMask)
+		if _, maskErr := channelmerge.ParseMask(channelMask); maskErr != nil {
+			err = maskErr
 			return
 		}
 
-		for _, c := range channelMask {
-			if !(c == 'r' || c == 'g' || c == 'b' || c == 'a' || c == 'x') {
-				err = fmt.Errorf("illegal character \"%c\" in channel mask \"%s\"", c, channelMask)
-				return
-			}
-		}
-
 		imgs = append(imgs, inputImage{
 			filepath:    args[i*2],
 			channelMask: channelMask,
@@ -85,80 +97,13 @@ func parseArgs(args []string) (imgs inputImages, outputPath string, err error) {
 
 	outputPath = args[len(args)-1]
 
-	if filepath.Ext(outputPath) != ".png" {
-		err = fmt.Errorf("only .png files are supported as output files")
+	if _, extErr := encoderFor(outputPath); extErr != nil {
+		err = extErr
 	}
 
 	return
 }
 
-func (img *inputImage) openImage() error {
-	inFile, err := os.Open(img.filepath)
-	if err != nil {
-		return err
-	}
-	defer inFile.Close()
-
-	inImg, _, err := image.Decode(inFile)
-	if err != nil {
-		return err
-	}
-
-	img.rgba = image.NewRGBA(inImg.Bounds())
-	draw.Draw(img.rgba, img.rgba.Bounds(), inImg, image.Point{0, 0}, draw.Src)
-
-	return nil
-}
-
-func (images inputImages) openImages() (maxSize image.Point, err error) {
-	for i := range images {
-		if err = images[i].openImage(); err != nil {
-			return
-		}
-		imgSize := images[i].rgba.Bounds().Size()
-		if imgSize.X > maxSize.X {
-			maxSize.X = imgSize.X
-		}
-		if imgSize.Y > maxSize.Y {
-			maxSize.Y = imgSize.Y
-		}
-	}
-	return
-}
-
-func (img inputImage) mergeChannels(outImg *image.NRGBA) {
-	if len(img.rgba.Pix) > len(outImg.Pix) {
-		// should not happen because the maximum size of all input images will be used for the output image
-		panic(fmt.Sprintf("input image is bigger than output image: input: %v, output: %v", img.rgba.Bounds(), outImg.Bounds()))
-	}
-
-	for i := 0; i < len(img.rgba.Pix)/4; i++ {
-		for j := 0; j < 4; j++ {
-			switch img.channelMask[j] {
-			case 'r':
-				outImg.Pix[i*4+0] = img.rgba.Pix[i*4+j]
-			case 'g':
-				outImg.Pix[i*4+1] = img.rgba.Pix[i*4+j]
-			case 'b':
-				outImg.Pix[i*4+2] = img.rgba.Pix[i*4+j]
-			case 'a':
-				outImg.Pix[i*4+3] = img.rgba.Pix[i*4+j]
-			case 'x':
-				// do nothing
-			default:
-				// should not happen, because parseArgs should already take care of that
-				panic(fmt.Sprintf("invalid character in channel mask: %c", img.channelMask[j]))
-			}
-		}
-	}
-}
-
-func (images inputImages) mergeChannels(outImg *image.NRGBA) {
-	for _, img := range images {
-		img.mergeChannels(outImg)
-	}
-}
-
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -167,4 +112,8 @@ func Execute() {
 }
 
 func init() {
+	RootCmd.Flags().StringVar(&bitDepthFlag, "bit-depth", "auto", "output bit depth per channel: 8, 16, or auto")
+	RootCmd.Flags().IntVar(&jpegQualityFlag, "jpeg-quality", 90, "JPEG quality (1-100), only used when the output file is a .jpg/.jpeg")
+	RootCmd.Flags().StringVar(&resizeFlag, "resize", "none", "resample inputs smaller than the output: none, nearest, bilinear, or lanczos")
+	RootCmd.Flags().BoolVar(&requireSameSizeFlag, "require-same-size", false, "fail instead of resizing or zero-padding when input images have different dimensions")
 }